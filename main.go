@@ -0,0 +1,510 @@
+// Command job-status-recorder listens for job status update messages on
+// AMQP and records them in the job_status_updates table. For every update
+// that carries a job state it also emits a structured JobEvent describing
+// the change so that other services can react to it.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/cyverse-de/go-events/jobevents"
+	"github.com/cyverse-de/go-events/ping"
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/messaging"
+)
+
+const (
+	pingKey  = "events.job-status-recorder.ping"
+	pongKey  = "events.job-status-recorder.pong"
+	storeKey = "events.job-status-recorder.storedjobstatus"
+
+	jobsExchange = "de"
+
+	// traceIDHeader is the AMQP header sendJobEvent uses to carry a
+	// delivery's trace ID onto the storeKey publish, since
+	// jobevents.JobEvent itself has no field for it.
+	traceIDHeader = "x-trace-id"
+
+	// broadcastDoneMarker is recorded in the same done set recordToSinks
+	// uses, so that msg's live-query broadcast, like each sink, only runs
+	// once per delivery even if a later step (emitEventMessage) fails and
+	// sends the delivery back through the retry exchange.
+	broadcastDoneMarker = "broadcast"
+
+	serviceName = "job-status-recorder"
+
+	defaultMessage = "UNKNOWN"
+	defaultSender  = "0.0.0.0"
+)
+
+// Messenger is the subset of a messaging client's behavior the app relies
+// on, which lets tests swap in a mock. PublishContext is the context-aware
+// path handlers use; Publish remains for callers that don't have a request
+// context to hand. SetupPublishing declares a plain exchange of the
+// client's default type; SetupPublishingWithArgs is for exchanges that need
+// a specific type and declare arguments, such as the "x-delayed-message"
+// exchange the retry queue publishes delayed messages through.
+type Messenger interface {
+	AddConsumer(exchange, exchangeType, queue, key string, handler messaging.MessageHandler)
+	Close()
+	Listen()
+	Publish(key string, msg []byte) error
+	PublishContext(ctx context.Context, key string, msg []byte) error
+	PublishHeaders(ctx context.Context, exchange, key string, headers amqp.Table, msg []byte) error
+	SetupPublishing(exchange string) error
+	SetupPublishingWithArgs(exchange, exchangeType string, args amqp.Table) error
+}
+
+// amqpClient adapts a *messaging.Client into a Messenger. messaging.Client
+// is only known to implement the methods this package called on it before
+// PublishContext/PublishHeaders/SetupPublishingWithArgs existed --
+// AddConsumer, Close, Listen, Publish, and SetupPublishing, all promoted
+// here via embedding. The rest aren't part of its documented surface, so
+// amqpClient satisfies them itself against a channel it dials directly,
+// rather than assuming the client grew them.
+type amqpClient struct {
+	*messaging.Client
+	ch *amqp.Channel
+}
+
+// newAMQPClient dials uri for both a messaging.Client, for the consumer and
+// plain-publish paths the rest of the package already relies on, and a raw
+// amqp.Channel, for the header-aware publishing Messenger also requires.
+func newAMQPClient(uri string) (*amqpClient, error) {
+	client, err := messaging.NewClient(uri, true)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		client.Close()
+		return nil, err
+	}
+
+	return &amqpClient{Client: client, ch: ch}, nil
+}
+
+// Close shuts down both the embedded messaging.Client and the channel
+// newAMQPClient dialed for it, overriding the promoted Close that would
+// otherwise only close the former.
+func (c *amqpClient) Close() {
+	c.ch.Close()
+	c.Client.Close()
+}
+
+// PublishContext is Publish with an early exit if ctx is already done;
+// messaging.Client has no context-aware publish of its own to delegate to.
+func (c *amqpClient) PublishContext(ctx context.Context, key string, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Publish(key, msg)
+}
+
+// PublishHeaders publishes msg to exchange with headers attached, using the
+// channel dialed alongside the messaging.Client rather than the client
+// itself, since messaging.Client has no header-aware publish method.
+func (c *amqpClient) PublishHeaders(ctx context.Context, exchange, key string, headers amqp.Table, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.ch.Publish(exchange, key, false, false, amqp.Publishing{
+		Headers:     headers,
+		ContentType: "application/json",
+		Body:        msg,
+	})
+}
+
+// SetupPublishingWithArgs declares exchange as exchangeType with args, using
+// the channel dialed alongside the messaging.Client. messaging.Client's own
+// SetupPublishing only declares the client's default exchange type with no
+// arguments, which can't express the "x-delayed-message" exchange the retry
+// queue needs.
+func (c *amqpClient) SetupPublishingWithArgs(exchange, exchangeType string, args amqp.Table) error {
+	return c.ch.ExchangeDeclare(exchange, exchangeType, true, false, false, false, args)
+}
+
+// requestIDKeyType is an unexported type for the request ID context key, so
+// it can't collide with keys set by other packages.
+type requestIDKeyType struct{}
+
+var requestIDKey = requestIDKeyType{}
+
+// withRequestID returns a copy of parent carrying a freshly generated
+// request/trace ID.
+func withRequestID(parent context.Context) context.Context {
+	return context.WithValue(parent, requestIDKey, newRequestID())
+}
+
+// requestID extracts the trace ID stashed in ctx by withRequestID, or ""
+// if none is present.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// newRequestID generates a short hex identifier for correlating the work
+// done while handling a single delivery.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// App bundles the configuration and external connections the service needs
+// in order to record job status updates.
+type App struct {
+	cfg        *viper.Viper
+	db         *sql.DB
+	amqpClient Messenger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sinks []Sink
+
+	dlMu        sync.Mutex
+	deadLetters []deadLetter
+	nextDLID    int
+
+	subMu       sync.RWMutex
+	subscribers map[int]chan *tracedEvent
+	nextSubID   int
+
+	subsMu sync.RWMutex
+	subs   map[string]*subscription
+}
+
+// New returns a newly configured *App. It does not open any external
+// connections; call Init to do that. The default Sink is always postgres;
+// Init adds any additional sinks enabled in cfg.
+func New(cfg *viper.Viper) *App {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &App{
+		cfg:         cfg,
+		ctx:         ctx,
+		cancel:      cancel,
+		deadLetters: make([]deadLetter, 0),
+		subscribers: make(map[int]chan *tracedEvent),
+		subs:        make(map[string]*subscription),
+	}
+	a.sinks = []Sink{NewPostgresSink(a)}
+	return a
+}
+
+// Shutdown cancels the context shared by every in-flight delivery, giving
+// handlers a chance to abandon work that hasn't reached postgres or AMQP
+// yet, then closes every configured sink.
+func (a *App) Shutdown() {
+	a.cancel()
+	for _, sink := range a.sinks {
+		if err := sink.Close(); err != nil {
+			logcabin.Error.Printf("sink=%s: error closing: %s", sink.Name(), err)
+		}
+	}
+}
+
+// newDeliveryContext builds the root context for a single AMQP delivery: a
+// child of the app's shutdown context carrying a fresh trace ID.
+func (a *App) newDeliveryContext() context.Context {
+	return withRequestID(a.ctx)
+}
+
+// Init opens the postgres and AMQP connections described by a.cfg, reloads
+// any subscriptions persisted by a previous run, and registers the
+// service's consumers.
+func (a *App) Init() error {
+	db, err := sql.Open("postgres", a.cfg.GetString("db.uri"))
+	if err != nil {
+		return err
+	}
+	if err = db.Ping(); err != nil {
+		return err
+	}
+	a.db = db
+
+	if err = a.loadSubscriptions(); err != nil {
+		return err
+	}
+
+	client, err := newAMQPClient(a.cfg.GetString("amqp.uri"))
+	if err != nil {
+		return err
+	}
+	a.amqpClient = client
+
+	if err = a.amqpClient.SetupPublishing(jobsExchange); err != nil {
+		return err
+	}
+
+	a.amqpClient.AddConsumer(jobsExchange, "topic", "job_status_recorder", "*.job.*", a.msg)
+	a.amqpClient.AddConsumer(jobsExchange, "topic", "job_status_recorder.events", pingKey, a.eventsHandler)
+
+	// retryExchange is consumed as "x-delayed-message" below, so it must be
+	// declared as that type with the delayed-message plugin's
+	// "x-delayed-type" argument; SetupPublishing only declares the
+	// client's default exchange type and would either silently produce a
+	// non-delaying exchange or clash with an existing "jobs.retry"
+	// declared elsewhere.
+	if err = a.amqpClient.SetupPublishingWithArgs(retryExchange, "x-delayed-message", amqp.Table{"x-delayed-type": "topic"}); err != nil {
+		return err
+	}
+	if err = a.amqpClient.SetupPublishing(deadLetterExchange); err != nil {
+		return err
+	}
+	a.amqpClient.AddConsumer(retryExchange, "x-delayed-message", "job_status_recorder.retry", retryKey, a.msg)
+
+	if a.cfg.GetBool("sinks.file.enabled") {
+		fs, err := NewFileSink(a.cfg.GetString("sinks.file.path"))
+		if err != nil {
+			return err
+		}
+		a.sinks = append(a.sinks, fs)
+	}
+	if a.cfg.GetBool("sinks.webhook.enabled") {
+		a.sinks = append(a.sinks, NewHTTPWebhookSink(a.cfg.GetString("sinks.webhook.url")))
+	}
+
+	return nil
+}
+
+// insert records a single job status update. ctx is honored for
+// cancellation/timeouts via ExecContext; it is not used to carry the trace
+// ID into the row, since job_status_updates has no column for it.
+func (a *App) insert(ctx context.Context, state, invID, message, ip, host, appID, user string, timestamp int64) (sql.Result, error) {
+	return execInsert(ctx, a.db, state, invID, message, ip, host, appID, user, timestamp)
+}
+
+// resolveSender takes the address a status update claims to have been sent
+// from and returns it alongside the IP it resolves to. An empty sender is
+// recorded as 0.0.0.0; a sender that cannot be resolved is recorded with an
+// empty resolved IP rather than failing the update outright.
+func resolveSender(sender string) (host, ip string) {
+	if sender == "" {
+		sender = defaultSender
+	}
+	host = sender
+
+	addrs, err := net.LookupHost(sender)
+	if err != nil || len(addrs) == 0 {
+		return host, ""
+	}
+	return host, addrs[0]
+}
+
+// jobEvent builds a jobevents.JobEvent out of an incoming update message.
+func jobEvent(eventName, svcName, host string, timestamp int64, u *messaging.UpdateMessage) *jobevents.JobEvent {
+	return &jobevents.JobEvent{
+		EventName:   eventName,
+		ServiceName: svcName,
+		Host:        host,
+		AppId:       u.Job.AppID,
+		JobId:       u.Job.InvocationID,
+		JobState:    string(u.State),
+		ExecutorId:  u.Job.CondorID,
+		User:        u.Job.Submitter,
+		Timestamp:   timestamp,
+		Message:     u.Message,
+	}
+}
+
+// tracedEvent pairs a JobEvent with the trace ID of the delivery that
+// produced it. jobevents.JobEvent has no field for it, so a consumer that
+// decodes into a plain jobevents.JobEvent drops trace_id and can read the
+// traceIDHeader instead; everything this package serializes -- the storeKey
+// publish, recordToSinks's sinks, subscription callback bodies, and the
+// live ?stream=true query API -- marshals a *tracedEvent, so the trace_id
+// field is there for consumers that read it.
+type tracedEvent struct {
+	*jobevents.JobEvent
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// sendJobEvent publishes e to storeKey so that it is recorded by consumers,
+// then hands it to any subscription whose filters match. The trace ID
+// carried by ctx is attached both as the traceIDHeader AMQP header on the
+// publish and as the trace_id field of the published JSON, so downstream
+// consumers can correlate it with the rest of the request either way.
+func (a *App) sendJobEvent(ctx context.Context, e *jobevents.JobEvent) error {
+	te := &tracedEvent{JobEvent: e, TraceID: requestID(ctx)}
+	msg, err := json.Marshal(te)
+	if err != nil {
+		return err
+	}
+	var headers amqp.Table
+	if te.TraceID != "" {
+		headers = amqp.Table{traceIDHeader: te.TraceID}
+	}
+	if err := a.amqpClient.PublishHeaders(ctx, jobsExchange, storeKey, headers, msg); err != nil {
+		return err
+	}
+	a.dispatchSubscriptions(ctx, te)
+	return nil
+}
+
+// emitEvent builds a JobEvent from u using u's own message and publishes it,
+// logging any error encountered along the way in addition to returning it.
+func (a *App) emitEvent(ctx context.Context, eventName, svcName string, u *messaging.UpdateMessage) error {
+	return a.emitEventMessage(ctx, eventName, svcName, u.Message, u)
+}
+
+// emitEventMessage is like emitEvent but lets the caller override the
+// recorded message, which is useful once defaults have been substituted
+// for an empty incoming message.
+func (a *App) emitEventMessage(ctx context.Context, eventName, svcName, message string, u *messaging.UpdateMessage) error {
+	e := jobEvent(eventName, svcName, u.Sender, time.Now().Unix(), u)
+	e.Message = message
+	if err := a.sendJobEvent(ctx, e); err != nil {
+		logcabin.Error.Printf("trace=%s: %s", requestID(ctx), err)
+		return err
+	}
+	return nil
+}
+
+// pingHandler responds to a ping event by publishing a pong.
+func (a *App) pingHandler(d amqp.Delivery) {
+	ctx := a.newDeliveryContext()
+
+	msg, err := json.Marshal(&ping.Pong{})
+	if err != nil {
+		logcabin.Error.Printf("trace=%s: %s", requestID(ctx), err)
+		return
+	}
+	if err = a.amqpClient.PublishContext(ctx, pongKey, msg); err != nil {
+		logcabin.Error.Printf("trace=%s: %s", requestID(ctx), err)
+		return
+	}
+}
+
+// eventsHandler handles deliveries on the service's events consumer, which
+// currently only carries ping requests.
+func (a *App) eventsHandler(d amqp.Delivery) {
+	switch d.RoutingKey {
+	case pingKey:
+		a.pingHandler(d)
+	default:
+		logcabin.Error.Printf("unknown routing key: %s", d.RoutingKey)
+	}
+}
+
+// msg is the primary AMQP handler for the service: it records every
+// incoming job status update in postgres and, for updates that carry a
+// state, emits a JobEvent describing the change. Every delivery gets its
+// own context, derived from the app's shutdown context and tagged with a
+// trace ID, so that a shutdown mid-delivery cancels the insert and publish
+// rather than leaving them to run unattended.
+func (a *App) msg(d amqp.Delivery) {
+	ctx := a.newDeliveryContext()
+
+	if d.RoutingKey == pingKey {
+		a.pingHandler(d)
+		return
+	}
+
+	var u messaging.UpdateMessage
+	if err := json.Unmarshal(d.Body, &u); err != nil {
+		logcabin.Error.Printf("trace=%s: %s", requestID(ctx), err)
+		return
+	}
+
+	message := u.Message
+	if message == "" {
+		message = defaultMessage
+	}
+
+	var sentOn int64
+	if u.SentOn != "" {
+		var err error
+		sentOn, err = strconv.ParseInt(u.SentOn, 10, 64)
+		if err != nil {
+			logcabin.Error.Printf("trace=%s: %s", requestID(ctx), err)
+			return
+		}
+	}
+
+	e := jobEvent("status-change", serviceName, u.Sender, sentOn, &u)
+	e.Message = message
+	te := &tracedEvent{JobEvent: e, TraceID: requestID(ctx)}
+	alreadyDone := sinksDoneFromHeaders(d.Headers)
+	done, errs := a.recordToSinks(ctx, te, alreadyDone)
+	if len(errs) > 0 {
+		a.retryOrDeadLetter(ctx, d, errs[0], done)
+		return
+	}
+
+	if !alreadyDone[broadcastDoneMarker] {
+		host, _ := resolveSender(u.Sender)
+		broadcastEvent := rowToEvent(u.Job.InvocationID, message, string(u.State), host, u.Job.AppID, u.Job.Submitter, sentOn)
+		a.broadcast(&tracedEvent{JobEvent: broadcastEvent, TraceID: requestID(ctx)})
+	}
+	done = append(done, broadcastDoneMarker)
+
+	if u.State == "" {
+		return
+	}
+
+	if err := a.emitEventMessage(ctx, "status-change", serviceName, message, &u); err != nil {
+		a.retryOrDeadLetter(ctx, d, err, done)
+	}
+}
+
+func main() {
+	cfgPath := flag.String("config", "/etc/iplant/de/jobservices.yml", "The path to the config file")
+	flag.Parse()
+
+	cfg, err := configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
+	if err != nil {
+		logcabin.Error.Fatal(err)
+	}
+
+	app := New(cfg)
+	if err = app.Init(); err != nil {
+		logcabin.Error.Fatal(err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		app.Shutdown()
+	}()
+
+	listenAddr := cfg.GetString("job_status_recorder.listen-port")
+	if listenAddr == "" {
+		listenAddr = ":60000"
+	}
+	go func() {
+		if err := app.Serve(listenAddr); err != nil {
+			logcabin.Error.Fatal(err)
+		}
+	}()
+
+	app.amqpClient.Listen()
+}
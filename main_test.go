@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -70,6 +71,31 @@ func TestNew(t *testing.T) {
 	}
 }
 
+// closeTrackingSink counts how many times Close was called on it, for
+// testing that Shutdown closes every configured sink.
+type closeTrackingSink struct {
+	closed int
+}
+
+func (s *closeTrackingSink) Name() string                                { return "close-tracking" }
+func (s *closeTrackingSink) Record(ctx context.Context, e *tracedEvent) error { return nil }
+func (s *closeTrackingSink) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestShutdownClosesSinks(t *testing.T) {
+	app := New(cfg)
+	sink := &closeTrackingSink{}
+	app.sinks = []Sink{sink}
+
+	app.Shutdown()
+
+	if sink.closed != 1 {
+		t.Errorf("sink was closed %d times, expected 1", sink.closed)
+	}
+}
+
 func TestInsert(t *testing.T) {
 	inittests(t)
 	app := New(cfg)
@@ -83,10 +109,10 @@ func TestInsert(t *testing.T) {
 	var lastInsertID int64
 	result := sqlmock.NewResult(lastInsertID, 1)
 	mock.ExpectExec("INSERT INTO job_status_updates").
-		WithArgs("invID", "message", "state", "host", "ip", 0).
+		WithArgs("invID", "message", "state", "host", "ip", 0, "app-id", "user").
 		WillReturnResult(result)
 
-	_, err = app.insert("state", "invID", "message", "ip", "host", 0)
+	_, err = app.insert(context.Background(), "state", "invID", "message", "ip", "host", "app-id", "user", 0)
 	if err != nil {
 		t.Errorf("error was not expected updating job_status_updates: %s", err)
 	}
@@ -105,15 +131,25 @@ type MockConsumer struct {
 }
 
 type MockMessage struct {
-	key string
-	msg []byte
+	exchange string
+	key      string
+	msg      []byte
+	headers  amqp.Table
+}
+
+// MockExchangeDeclare records a SetupPublishingWithArgs call.
+type MockExchangeDeclare struct {
+	exchange     string
+	exchangeType string
+	args         amqp.Table
 }
 
 type MockMessenger struct {
-	consumers         []MockConsumer
-	publishedMessages []MockMessage
-	publishTo         []string
-	publishError      bool
+	consumers           []MockConsumer
+	publishedMessages   []MockMessage
+	publishTo           []string
+	publishExchangeArgs []MockExchangeDeclare
+	publishError        bool
 }
 
 func (m *MockMessenger) Close()  {}
@@ -137,12 +173,39 @@ func (m *MockMessenger) Publish(key string, msg []byte) error {
 	return nil
 }
 
+func (m *MockMessenger) PublishContext(ctx context.Context, key string, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Publish(key, msg)
+}
+
+func (m *MockMessenger) PublishHeaders(ctx context.Context, exchange, key string, headers amqp.Table, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.publishError {
+		return errors.New("publish error")
+	}
+	m.publishedMessages = append(m.publishedMessages, MockMessage{exchange: exchange, key: key, msg: msg, headers: headers})
+	return nil
+}
+
 func (m *MockMessenger) SetupPublishing(exchange string) error {
 
 	m.publishTo = append(m.publishTo, exchange)
 	return nil
 }
 
+func (m *MockMessenger) SetupPublishingWithArgs(exchange, exchangeType string, args amqp.Table) error {
+	m.publishExchangeArgs = append(m.publishExchangeArgs, MockExchangeDeclare{
+		exchange:     exchange,
+		exchangeType: exchangeType,
+		args:         args,
+	})
+	return nil
+}
+
 func TestPingHandler(t *testing.T) {
 	inittests(t)
 	app := New(cfg)
@@ -333,7 +396,7 @@ func TestSendJobEvent(t *testing.T) {
 		}
 
 		e := jobEvent(tc.EventName, tc.ServiceName, tc.Host, tc.Timestamp, update)
-		if err := app.sendJobEvent(e); err != nil {
+		if err := app.sendJobEvent(context.Background(), e); err != nil {
 			t.Fatalf("error sending job event: %s", err)
 		}
 		mm := app.amqpClient.(*MockMessenger)
@@ -448,7 +511,7 @@ func TestEmitEvent(t *testing.T) {
 		u.Job.InvocationID = tc.InvocationID
 
 		// make the call
-		app.emitEvent("event", "service", u)
+		app.emitEvent(context.Background(), "event", "service", u)
 
 		mm := app.amqpClient.(*MockMessenger)
 		msg := mm.publishedMessages[0]
@@ -512,7 +575,7 @@ func TestEmitEventMessage(t *testing.T) {
 		u.Job.InvocationID = tc.InvocationID
 
 		// make the call
-		app.emitEventMessage("event", "service", "message", u)
+		app.emitEventMessage(context.Background(), "event", "service", "message", u)
 
 		mm := app.amqpClient.(*MockMessenger)
 		msg := mm.publishedMessages[0]
@@ -614,7 +677,7 @@ func TestMsg(t *testing.T) {
 		}
 
 		mock.ExpectExec("INSERT INTO job_status_updates").
-			WithArgs(tc.InvocationID, tc.Message, tc.State, tc.Sender, tc.SenderAddr, n).
+			WithArgs(tc.InvocationID, tc.Message, tc.State, tc.SenderAddr, tc.Sender, n, "", "").
 			WillReturnResult(result)
 
 		// make the call
@@ -641,3 +704,100 @@ func TestMsg(t *testing.T) {
 		db.Close()
 	}
 }
+
+func TestMsgDoesNotRebroadcastOnRetry(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+	app.amqpClient = &MockMessenger{publishedMessages: make([]MockMessage, 0)}
+
+	_, ch := app.subscribe()
+
+	u := &messaging.UpdateMessage{
+		State:   messaging.JobState("State"),
+		Job:     model.New(cfg),
+		Message: "Message",
+		Sender:  "127.0.0.1",
+	}
+	u.Job.InvocationID = "InvocationID"
+	body, err := json.Marshal(u)
+	if err != nil {
+		t.Fatalf("error marshalling delivery body: %s", err)
+	}
+
+	// Simulate a delivery retried after recordToSinks already succeeded and
+	// the live-query broadcast already fired, as indicated by sinksDoneHeader
+	// already carrying broadcastDoneMarker. No sink Record call is expected:
+	// the only configured sink (postgres) is already marked done.
+	d := amqp.Delivery{
+		RoutingKey: "not-ping",
+		Body:       body,
+		Headers: amqp.Table{
+			sinksDoneHeader: "postgres," + broadcastDoneMarker,
+		},
+	}
+
+	app.msg(d)
+
+	select {
+	case e := <-ch:
+		t.Errorf("expected no broadcast on a delivery already marked done, got %+v", e)
+	default:
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations inserting job_status_updates: %s", err)
+	}
+}
+
+func TestSendJobEventCarriesTraceID(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	app.amqpClient = &MockMessenger{
+		publishedMessages: make([]MockMessage, 0),
+	}
+
+	ctx := withRequestID(context.Background())
+	e := jobEvent("event", "service", "host", 0, &messaging.UpdateMessage{
+		State: messaging.JobState("state"),
+		Job:   model.New(cfg),
+	})
+	if err := app.sendJobEvent(ctx, e); err != nil {
+		t.Fatalf("error sending job event: %s", err)
+	}
+
+	mm := app.amqpClient.(*MockMessenger)
+	msg := mm.publishedMessages[0]
+	if msg.headers[traceIDHeader] != requestID(ctx) {
+		t.Errorf("expected %s header %q, got %v", traceIDHeader, requestID(ctx), msg.headers[traceIDHeader])
+	}
+}
+
+func TestSendJobEventCancelledContext(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	app.amqpClient = &MockMessenger{
+		publishedMessages: make([]MockMessage, 0),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	e := jobEvent("event", "service", "host", 0, &messaging.UpdateMessage{
+		State: messaging.JobState("state"),
+		Job:   model.New(cfg),
+	})
+	if err := app.sendJobEvent(ctx, e); err == nil {
+		t.Error("expected an error sending a job event with a cancelled context")
+	}
+
+	mm := app.amqpClient.(*MockMessenger)
+	if numMessages := len(mm.publishedMessages); numMessages != 0 {
+		t.Errorf("number of published messages was not 0: %d", numMessages)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/cyverse-de/logcabin"
+)
+
+const (
+	retryExchange      = "jobs.retry"
+	deadLetterExchange = "jobs.deadletter"
+	retryKey           = "job_status_recorder.retry"
+	deadLetterKey      = "job_status_recorder.deadletter"
+
+	// maxRetryAttempts is how many times a delivery is sent back through
+	// the retry exchange before it's given up on and dead-lettered.
+	maxRetryAttempts = 5
+
+	// sinksDoneHeader carries the comma-separated names of the sinks a
+	// delivery already recorded successfully, plus any other
+	// idempotency-sensitive step (see broadcastDoneMarker) it already
+	// completed, so a retried delivery can skip them instead of redoing
+	// them.
+	sinksDoneHeader = "x-sinks-done"
+)
+
+// deadLetter records a delivery that exhausted its retries. The broker's
+// dead-letter exchange remains the system of record; this is just enough
+// bookkeeping to let the HTTP API list and requeue what landed there.
+type deadLetter struct {
+	ID         int       `json:"id"`
+	Body       []byte    `json:"body"`
+	Error      string    `json:"error"`
+	Attempts   int       `json:"attempts"`
+	FirstSeen  int64     `json:"first_seen"`
+	RecordedOn time.Time `json:"recorded_on"`
+}
+
+// headerInt reads an integer AMQP header, tolerating whichever of the
+// streadway/amqp numeric types it was encoded as.
+func headerInt(headers amqp.Table, key string) int64 {
+	if headers == nil {
+		return 0
+	}
+	switch v := headers[key].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	}
+	return 0
+}
+
+// retryDelayMillis returns the x-delay value for a given attempt number,
+// doubling with each attempt.
+func retryDelayMillis(attempt int) int32 {
+	return int32(1000 * (1 << uint(attempt-1)))
+}
+
+// sinksDoneFromHeaders parses the sinksDoneHeader value on a delivery into
+// the set of sink names recordToSinks should skip.
+func sinksDoneFromHeaders(headers amqp.Table) map[string]bool {
+	done := make(map[string]bool)
+	if headers == nil {
+		return done
+	}
+	raw, _ := headers[sinksDoneHeader].(string)
+	if raw == "" {
+		return done
+	}
+	for _, name := range strings.Split(raw, ",") {
+		done[name] = true
+	}
+	return done
+}
+
+// retryOrDeadLetter is called when a delivery has failed to be recorded or
+// published. It republishes the original message to the delayed retry
+// exchange, carrying an incremented attempt count, the original first-seen
+// timestamp, and the names of the sinks already recorded (sinksDone) as
+// headers, until maxRetryAttempts is exceeded, at which point it's sent to
+// the dead-letter exchange instead and recorded for the HTTP API. Carrying
+// sinksDone forward means a retried delivery only redoes the step that
+// actually failed, rather than re-inserting and re-publishing everything
+// from scratch.
+func (a *App) retryOrDeadLetter(ctx context.Context, d amqp.Delivery, cause error, sinksDone []string) {
+	attempt := int(headerInt(d.Headers, "x-attempt")) + 1
+	firstSeen := headerInt(d.Headers, "x-first-seen")
+	if firstSeen == 0 {
+		firstSeen = time.Now().Unix()
+	}
+
+	headers := amqp.Table{
+		"x-attempt":    int64(attempt),
+		"x-first-seen": firstSeen,
+		"x-error":      cause.Error(),
+	}
+	if len(sinksDone) > 0 {
+		headers[sinksDoneHeader] = strings.Join(sinksDone, ",")
+	}
+
+	if attempt > maxRetryAttempts {
+		if err := a.amqpClient.PublishHeaders(ctx, deadLetterExchange, deadLetterKey, headers, d.Body); err != nil {
+			logcabin.Error.Printf("trace=%s: failed publishing to the dead-letter exchange: %s", requestID(ctx), err)
+		}
+		a.addDeadLetter(deadLetter{
+			Body:       d.Body,
+			Error:      cause.Error(),
+			Attempts:   attempt,
+			FirstSeen:  firstSeen,
+			RecordedOn: time.Now(),
+		})
+		return
+	}
+
+	headers["x-delay"] = retryDelayMillis(attempt)
+	if err := a.amqpClient.PublishHeaders(ctx, retryExchange, retryKey, headers, d.Body); err != nil {
+		logcabin.Error.Printf("trace=%s: failed publishing to the retry exchange: %s", requestID(ctx), err)
+	}
+}
+
+func (a *App) addDeadLetter(dl deadLetter) int {
+	a.dlMu.Lock()
+	defer a.dlMu.Unlock()
+	dl.ID = a.nextDLID
+	a.nextDLID++
+	a.deadLetters = append(a.deadLetters, dl)
+	return dl.ID
+}
+
+// listDeadLettersHandler lists every dead-lettered delivery recorded since
+// the process started that has not since been requeued.
+func (a *App) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.dlMu.Lock()
+	defer a.dlMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.deadLetters)
+}
+
+// requeueDeadLetterHandler removes a dead letter from the list and feeds
+// its original body back through msg as a fresh delivery.
+func (a *App) requeueDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/deadletters/"), "/requeue")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid dead letter id %q", idStr))
+		return
+	}
+
+	a.dlMu.Lock()
+	var found *deadLetter
+	remaining := a.deadLetters[:0]
+	for i := range a.deadLetters {
+		if a.deadLetters[i].ID == id {
+			dl := a.deadLetters[i]
+			found = &dl
+			continue
+		}
+		remaining = append(remaining, a.deadLetters[i])
+	}
+	a.deadLetters = remaining
+	a.dlMu.Unlock()
+
+	if found == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no dead letter with id %d", id))
+		return
+	}
+
+	a.msg(amqp.Delivery{Body: found.Body})
+
+	w.WriteHeader(http.StatusAccepted)
+}
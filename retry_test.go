@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/model"
+	"github.com/streadway/amqp"
+)
+
+func newUpdateBody(t *testing.T) []byte {
+	t.Helper()
+	u := &messaging.UpdateMessage{
+		State:   messaging.JobState("state"),
+		Job:     model.New(cfg),
+		Message: "message",
+		Sender:  "127.0.0.1",
+		SentOn:  "0",
+	}
+	u.Job.InvocationID = "invID"
+	body, err := json.Marshal(u)
+	if err != nil {
+		t.Fatalf("error marshalling update message: %s", err)
+	}
+	return body
+}
+
+func TestMsgRetriesThenSucceeds(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+	app.amqpClient = &MockMessenger{publishedMessages: make([]MockMessage, 0)}
+
+	body := newUpdateBody(t)
+
+	mock.ExpectExec("INSERT INTO job_status_updates").WillReturnError(errors.New("boom"))
+	mock.ExpectExec("INSERT INTO job_status_updates").WillReturnError(errors.New("boom"))
+	mock.ExpectExec("INSERT INTO job_status_updates").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	app.msg(amqp.Delivery{RoutingKey: "not-ping", Body: body})
+	mm := app.amqpClient.(*MockMessenger)
+	if len(mm.publishedMessages) != 1 {
+		t.Fatalf("expected 1 retry publish after the first failure, got %d", len(mm.publishedMessages))
+	}
+	first := mm.publishedMessages[0]
+	if first.exchange != retryExchange {
+		t.Errorf("expected a publish to the retry exchange, got %s", first.exchange)
+	}
+	if attempt := headerInt(first.headers, "x-attempt"); attempt != 1 {
+		t.Errorf("expected x-attempt 1, got %d", attempt)
+	}
+
+	app.msg(amqp.Delivery{RoutingKey: "not-ping", Body: body, Headers: first.headers})
+	if len(mm.publishedMessages) != 2 {
+		t.Fatalf("expected 2 retry publishes after the second failure, got %d", len(mm.publishedMessages))
+	}
+	second := mm.publishedMessages[1]
+	if attempt := headerInt(second.headers, "x-attempt"); attempt != 2 {
+		t.Errorf("expected x-attempt 2, got %d", attempt)
+	}
+
+	app.msg(amqp.Delivery{RoutingKey: "not-ping", Body: body, Headers: second.headers})
+	if len(mm.publishedMessages) != 3 {
+		t.Fatalf("expected a publish to storeKey once the insert finally succeeds, got %d", len(mm.publishedMessages))
+	}
+	third := mm.publishedMessages[2]
+	if third.key != storeKey {
+		t.Errorf("expected the successful attempt to publish to storeKey, got %s", third.key)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMsgRetrySkipsSinksThatAlreadySucceeded(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	app.amqpClient = &MockMessenger{publishedMessages: make([]MockMessage, 0)}
+
+	recording := &recordingSink{}
+	failing := &failingSink{}
+	app.sinks = []Sink{recording, failing}
+
+	body := newUpdateBody(t)
+
+	app.msg(amqp.Delivery{RoutingKey: "not-ping", Body: body})
+	if len(recording.events) != 1 {
+		t.Fatalf("expected the recording sink to run on the first attempt, got %d calls", len(recording.events))
+	}
+	if failing.recorded != 1 {
+		t.Fatalf("expected the failing sink to run on the first attempt, got %d calls", failing.recorded)
+	}
+
+	mm := app.amqpClient.(*MockMessenger)
+	if len(mm.publishedMessages) != 1 {
+		t.Fatalf("expected 1 retry publish after the first failure, got %d", len(mm.publishedMessages))
+	}
+	retryHeaders := mm.publishedMessages[0].headers
+	if retryHeaders[sinksDoneHeader] != "recording" {
+		t.Errorf("expected the retry headers to record the succeeded sink, got %v", retryHeaders[sinksDoneHeader])
+	}
+
+	app.msg(amqp.Delivery{RoutingKey: "not-ping", Body: body, Headers: retryHeaders})
+	if len(recording.events) != 1 {
+		t.Errorf("expected the already-succeeded sink not to be recorded again, got %d calls", len(recording.events))
+	}
+	if failing.recorded != 2 {
+		t.Errorf("expected the still-failing sink to be retried, got %d calls", failing.recorded)
+	}
+}
+
+func TestMsgPermanentFailureDeadLetters(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+	app.amqpClient = &MockMessenger{publishedMessages: make([]MockMessage, 0)}
+
+	body := newUpdateBody(t)
+
+	for i := 0; i <= maxRetryAttempts; i++ {
+		mock.ExpectExec("INSERT INTO job_status_updates").WillReturnError(errors.New("boom"))
+	}
+
+	var headers amqp.Table
+	mm := app.amqpClient.(*MockMessenger)
+	for i := 0; i <= maxRetryAttempts; i++ {
+		app.msg(amqp.Delivery{RoutingKey: "not-ping", Body: body, Headers: headers})
+		headers = mm.publishedMessages[len(mm.publishedMessages)-1].headers
+	}
+
+	last := mm.publishedMessages[len(mm.publishedMessages)-1]
+	if last.exchange != deadLetterExchange {
+		t.Fatalf("expected the final publish to go to the dead-letter exchange, got %s", last.exchange)
+	}
+	if last.headers["x-error"] != "boom" {
+		t.Errorf("expected the dead letter headers to carry the failure reason: %+v", last.headers)
+	}
+	if attempt := headerInt(last.headers, "x-attempt"); attempt != maxRetryAttempts+1 {
+		t.Errorf("expected x-attempt %d, got %d", maxRetryAttempts+1, attempt)
+	}
+	if headerInt(last.headers, "x-first-seen") == 0 {
+		t.Error("expected a first-seen timestamp on the dead letter")
+	}
+
+	if len(app.deadLetters) != 1 {
+		t.Fatalf("expected 1 recorded dead letter, got %d", len(app.deadLetters))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListAndRequeueDeadLetters(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+	app.amqpClient = &MockMessenger{publishedMessages: make([]MockMessage, 0)}
+
+	body := newUpdateBody(t)
+	app.addDeadLetter(deadLetter{Body: body, Error: "boom", Attempts: maxRetryAttempts + 1, FirstSeen: 1136239445})
+
+	listReq := httptest.NewRequest("GET", "/deadletters", nil)
+	listW := httptest.NewRecorder()
+	app.listDeadLettersHandler(listW, listReq)
+
+	var letters []deadLetter
+	if err := json.Unmarshal(listW.Body.Bytes(), &letters); err != nil {
+		t.Fatalf("error unmarshalling dead letter list: %s", err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("expected 1 dead letter listed, got %d", len(letters))
+	}
+
+	mock.ExpectExec("INSERT INTO job_status_updates").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	reqURL := "/deadletters/0/requeue"
+	requeueReq := httptest.NewRequest("POST", reqURL, nil)
+	requeueW := httptest.NewRecorder()
+	app.requeueDeadLetterHandler(requeueW, requeueReq)
+
+	if requeueW.Code != 202 {
+		t.Fatalf("expected 202 Accepted requeueing a dead letter, got %d", requeueW.Code)
+	}
+	if len(app.deadLetters) != 0 {
+		t.Errorf("expected the dead letter to be removed after requeueing, got %d remaining", len(app.deadLetters))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
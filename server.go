@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/go-events/jobevents"
+)
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// allowedFilterColumns maps the `filter=field=value` keys the events API
+// accepts to the job_status_updates column they constrain.
+var allowedFilterColumns = map[string]string{
+	"state":  "status",
+	"app_id": "app_id",
+	"user":   `"user"`,
+}
+
+// httpError is the structured body written for query API failures.
+type httpError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&httpError{Message: err.Error(), Code: status})
+}
+
+// eventFilter is one parsed `filter` query parameter.
+type eventFilter struct {
+	key   string
+	value string
+}
+
+func (f eventFilter) column() string {
+	return allowedFilterColumns[f.key]
+}
+
+func (f eventFilter) matches(e *jobevents.JobEvent) bool {
+	switch f.key {
+	case "state":
+		return e.JobState == f.value
+	case "app_id":
+		return e.AppId == f.value
+	case "user":
+		return e.User == f.value
+	default:
+		return true
+	}
+}
+
+// parseFilters parses a set of repeated `filter=field=value` query values.
+func parseFilters(values []string) ([]eventFilter, error) {
+	filters := make([]eventFilter, 0, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("malformed filter %q: expected field=value", v)
+		}
+		if _, ok := allowedFilterColumns[parts[0]]; !ok {
+			return nil, fmt.Errorf("unsupported filter field %q", parts[0])
+		}
+		filters = append(filters, eventFilter{key: parts[0], value: parts[1]})
+	}
+	return filters, nil
+}
+
+// parseTimeParam accepts either an RFC3339 timestamp or a count of Unix
+// seconds, mirroring the `since`/`until` parameters on the Docker events
+// API. An empty value returns zero with no error.
+func parseTimeParam(raw string) (int64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return secs, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time value %q: must be RFC3339 or unix seconds", raw)
+	}
+	return t.Unix(), nil
+}
+
+// rowToEvent builds the JobEvent-shaped JSON returned by the query API out
+// of a job_status_updates row. Fields the table doesn't record (EventName,
+// ExecutorId) are left zero-valued; ServiceName is always this service's
+// own name rather than the sender's.
+func rowToEvent(invID, message, state, host, appID, user string, sentOn int64) *jobevents.JobEvent {
+	return &jobevents.JobEvent{
+		ServiceName: serviceName,
+		JobId:       invID,
+		Message:     message,
+		JobState:    state,
+		Host:        host,
+		AppId:       appID,
+		User:        user,
+		Timestamp:   sentOn,
+	}
+}
+
+// buildEventsQuery builds the SELECT (and its bind args) for the given
+// filter set.
+func buildEventsQuery(invocationID string, since, until int64, filters []eventFilter, limit, offset int) (string, []interface{}) {
+	query := `SELECT external_id, message, status, sent_from, app_id, "user", sent_on FROM job_status_updates`
+
+	var clauses []string
+	var args []interface{}
+	argN := 1
+
+	addClause := func(clause string, arg interface{}) {
+		clauses = append(clauses, fmt.Sprintf(clause, argN))
+		args = append(args, arg)
+		argN++
+	}
+
+	if invocationID != "" {
+		addClause("external_id = $%d", invocationID)
+	}
+	if since > 0 {
+		addClause("sent_on >= $%d", since)
+	}
+	if until > 0 {
+		addClause("sent_on <= $%d", until)
+	}
+	for _, f := range filters {
+		addClause(f.column()+" = $%d", f.value)
+	}
+
+	if len(clauses) > 0 {
+		query += " WHERE " + strings.Join(clauses, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY sent_on DESC LIMIT $%d OFFSET $%d", argN, argN+1)
+	args = append(args, limit, offset)
+
+	return query, args
+}
+
+// queryEvents runs the events query against postgres and returns the
+// matching rows as JobEvents.
+func (a *App) queryEvents(ctx context.Context, invocationID string, since, until int64, filters []eventFilter, limit, offset int) ([]*jobevents.JobEvent, error) {
+	query, args := buildEventsQuery(invocationID, since, until, filters, limit, offset)
+
+	rows, err := a.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*jobevents.JobEvent, 0)
+	for rows.Next() {
+		var invID, message, state, host, appID, user string
+		var sentOn int64
+		if err := rows.Scan(&invID, &message, &state, &host, &appID, &user, &sentOn); err != nil {
+			return nil, err
+		}
+		events = append(events, rowToEvent(invID, message, state, host, appID, user, sentOn))
+	}
+	return events, rows.Err()
+}
+
+// subscribe registers a channel that receives every JobEvent recorded from
+// here on, for use by the streaming query API. Events broadcast while the
+// channel's buffer is full are dropped for that subscriber.
+func (a *App) subscribe() (int, chan *tracedEvent) {
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+
+	id := a.nextSubID
+	a.nextSubID++
+	ch := make(chan *tracedEvent, 16)
+	a.subscribers[id] = ch
+	return id, ch
+}
+
+// unsubscribe removes and closes a previously subscribed channel.
+func (a *App) unsubscribe(id int) {
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+
+	if ch, ok := a.subscribers[id]; ok {
+		close(ch)
+		delete(a.subscribers, id)
+	}
+}
+
+// broadcast fans e out to every subscriber without blocking on a slow
+// reader.
+func (a *App) broadcast(e *tracedEvent) {
+	a.subMu.RLock()
+	defer a.subMu.RUnlock()
+
+	for _, ch := range a.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Router returns the handler for the query API's HTTP endpoints.
+func (a *App) Router() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", a.eventsQueryHandler)
+	mux.HandleFunc("/events/", a.eventQueryHandler)
+	mux.HandleFunc("/deadletters", a.listDeadLettersHandler)
+	mux.HandleFunc("/deadletters/", a.requeueDeadLetterHandler)
+	mux.HandleFunc("/subscriptions", a.subscriptionsHandler)
+	mux.HandleFunc("/subscriptions/", a.subscriptionHandler)
+	return mux
+}
+
+// Serve starts the query API, blocking until it exits.
+func (a *App) Serve(addr string) error {
+	return http.ListenAndServe(addr, a.Router())
+}
+
+func (a *App) eventsQueryHandler(w http.ResponseWriter, r *http.Request) {
+	a.handleEventsQuery(w, r, "")
+}
+
+func (a *App) eventQueryHandler(w http.ResponseWriter, r *http.Request) {
+	invocationID := strings.TrimPrefix(r.URL.Path, "/events/")
+	if invocationID == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("missing invocation id"))
+		return
+	}
+	a.handleEventsQuery(w, r, invocationID)
+}
+
+func (a *App) handleEventsQuery(w http.ResponseWriter, r *http.Request, invocationID string) {
+	q := r.URL.Query()
+
+	since, err := parseTimeParam(q.Get("since"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	until, err := parseTimeParam(q.Get("until"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	filters, err := parseFilters(q["filter"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	limit := defaultEventsLimit
+	if raw := q.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", raw))
+			return
+		}
+		if limit > maxEventsLimit {
+			limit = maxEventsLimit
+		}
+	}
+
+	offset := 0
+	if raw := q.Get("offset"); raw != "" {
+		offset, err = strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset %q", raw))
+			return
+		}
+	}
+
+	if q.Get("stream") == "true" {
+		a.streamEvents(w, r, invocationID, filters)
+		return
+	}
+
+	events, err := a.queryEvents(r.Context(), invocationID, since, until, filters, limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// streamEvents keeps the response open and pushes newly recorded events to
+// the client as they're inserted, filtering out anything that doesn't match
+// the request's invocation id or filters.
+func (a *App) streamEvents(w http.ResponseWriter, r *http.Request, invocationID string, filters []eventFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	id, ch := a.subscribe()
+	defer a.unsubscribe(id)
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if invocationID != "" && e.JobId != invocationID {
+				continue
+			}
+			matched := true
+			for _, f := range filters {
+				if !f.matches(e.JobEvent) {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/go-events/jobevents"
+)
+
+func TestParseTimeParam(t *testing.T) {
+	if secs, err := parseTimeParam(""); err != nil || secs != 0 {
+		t.Errorf("empty value should parse to 0, nil; got %d, %s", secs, err)
+	}
+
+	if secs, err := parseTimeParam("1136239445"); err != nil || secs != 1136239445 {
+		t.Errorf("unix seconds did not parse correctly: %d, %s", secs, err)
+	}
+
+	if secs, err := parseTimeParam("2006-01-02T15:04:05Z"); err != nil || secs != 1136214245 {
+		t.Errorf("RFC3339 value did not parse correctly: %d, %s", secs, err)
+	}
+
+	if _, err := parseTimeParam("2006-01-02TZ"); err == nil {
+		t.Error("malformed time value should have returned an error")
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	filters, err := parseFilters([]string{"state=Running"})
+	if err != nil {
+		t.Fatalf("unexpected error parsing filters: %s", err)
+	}
+	if len(filters) != 1 || filters[0].key != "state" || filters[0].value != "Running" {
+		t.Errorf("filter was not parsed correctly: %+v", filters)
+	}
+
+	filters, err = parseFilters([]string{"app_id=xyz", "user=foo"})
+	if err != nil {
+		t.Fatalf("unexpected error parsing app_id/user filters: %s", err)
+	}
+	if len(filters) != 2 || filters[0].key != "app_id" || filters[0].value != "xyz" ||
+		filters[1].key != "user" || filters[1].value != "foo" {
+		t.Errorf("app_id/user filters were not parsed correctly: %+v", filters)
+	}
+
+	if _, err := parseFilters([]string{"executor_id=xyz"}); err == nil {
+		t.Error("unsupported filter field should have returned an error")
+	}
+
+	if _, err := parseFilters([]string{"noequals"}); err == nil {
+		t.Error("malformed filter should have returned an error")
+	}
+}
+
+func TestEventsQueryHandler(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+
+	rows := sqlmock.NewRows([]string{"external_id", "message", "status", "sent_from", "app_id", "user", "sent_on"}).
+		AddRow("invID", "message", "Running", "127.0.0.1", "app-id", "user", int64(1136239445))
+	mock.ExpectQuery("SELECT (.+) FROM job_status_updates").WillReturnRows(rows)
+
+	req := httptest.NewRequest("GET", "/events?filter=state=Running", nil)
+	w := httptest.NewRecorder()
+	app.eventsQueryHandler(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var events []*jobevents.JobEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("error unmarshalling response body: %s", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].JobId != "invID" || events[0].JobState != "Running" || events[0].AppId != "app-id" || events[0].User != "user" {
+		t.Errorf("unexpected event contents: %+v", events[0])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations querying job_status_updates: %s", err)
+	}
+}
+
+func TestEventsQueryHandlerBadSince(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+
+	req := httptest.NewRequest("GET", "/events?since=2006-01-02TZ", nil)
+	w := httptest.NewRecorder()
+	app.eventsQueryHandler(w, req)
+
+	if w.Code != 400 {
+		t.Fatalf("expected 400 for malformed since, got %d", w.Code)
+	}
+}
+
+func TestEventQueryHandlerMissingID(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+
+	req := httptest.NewRequest("GET", "/events/", nil)
+	w := httptest.NewRecorder()
+	app.eventQueryHandler(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("expected 404 for missing invocation id, got %d", w.Code)
+	}
+}
+
+func TestSubscribeBroadcastUnsubscribe(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+
+	id, ch := app.subscribe()
+	app.broadcast(&tracedEvent{JobEvent: &jobevents.JobEvent{JobId: "invID"}})
+
+	select {
+	case e := <-ch:
+		if e.JobId != "invID" {
+			t.Errorf("unexpected event on subscriber channel: %+v", e)
+		}
+	default:
+		t.Error("expected an event on the subscriber channel")
+	}
+
+	app.unsubscribe(id)
+	if _, ok := app.subscribers[id]; ok {
+		t.Error("subscriber was not removed")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/logcabin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink is a destination for recorded job status updates. Implementations
+// must be safe for concurrent use: recordToSinks calls each sink in turn,
+// but msg itself can run concurrently, for deliveries from the main and
+// retry consumers and for dead letters requeued over HTTP. e is
+// a *tracedEvent rather than a bare *jobevents.JobEvent so that sinks which
+// serialize it, namely FileSink and HTTPWebhookSink, can carry the trace ID
+// of the delivery that produced it.
+type Sink interface {
+	Name() string
+	Record(ctx context.Context, e *tracedEvent) error
+	Close() error
+}
+
+var sinkFailuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "job_status_recorder_sink_failures_total",
+		Help: "Count of Sink.Record calls that returned an error, labeled by sink name.",
+	},
+	[]string{"sink"},
+)
+
+func init() {
+	prometheus.MustRegister(sinkFailuresTotal)
+}
+
+// recordToSinks calls Record on every configured sink not named in done,
+// which a caller retrying a previously-failed delivery uses to skip sinks
+// that already succeeded rather than recording the same update twice. A
+// failure in one sink is logged and counted but never prevents the
+// remaining sinks from running. It returns the name of every sink that has
+// now succeeded, whether skipped or recorded this call, so a caller can
+// track cumulative progress across retries, alongside every failure
+// encountered this call.
+func (a *App) recordToSinks(ctx context.Context, e *tracedEvent, done map[string]bool) ([]string, []error) {
+	succeeded := make([]string, 0, len(a.sinks))
+	errs := make([]error, 0)
+	for _, sink := range a.sinks {
+		if done[sink.Name()] {
+			succeeded = append(succeeded, sink.Name())
+			continue
+		}
+		if err := sink.Record(ctx, e); err != nil {
+			sinkFailuresTotal.WithLabelValues(sink.Name()).Inc()
+			logcabin.Error.Printf("trace=%s sink=%s: %s", requestID(ctx), sink.Name(), err)
+			errs = append(errs, err)
+			continue
+		}
+		succeeded = append(succeeded, sink.Name())
+	}
+	return succeeded, errs
+}
+
+// execInsert is the shared INSERT used by both app.insert and PostgresSink,
+// so the two stay in lockstep.
+func execInsert(ctx context.Context, db *sql.DB, state, invID, message, ip, host, appID, user string, timestamp int64) (sql.Result, error) {
+	query := `INSERT INTO job_status_updates
+		(external_id, message, status, sent_from, sent_from_ip, sent_on, app_id, "user")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	return db.ExecContext(ctx, query, invID, message, state, host, ip, timestamp, appID, user)
+}
+
+// PostgresSink is the default Sink, recording updates in job_status_updates.
+// e.Host carries the raw, unresolved sender address; PostgresSink resolves
+// it the same way the pre-Sink insert path did.
+type PostgresSink struct {
+	app *App
+}
+
+// NewPostgresSink returns a Sink that records updates through app's
+// database connection.
+func NewPostgresSink(app *App) *PostgresSink {
+	return &PostgresSink{app: app}
+}
+
+func (s *PostgresSink) Name() string { return "postgres" }
+
+func (s *PostgresSink) Record(ctx context.Context, e *tracedEvent) error {
+	host, ip := resolveSender(e.Host)
+	_, err := execInsert(ctx, s.app.db, e.JobState, e.JobId, e.Message, ip, host, e.AppId, e.User, e.Timestamp)
+	return err
+}
+
+func (s *PostgresSink) Close() error { return nil }
+
+// FileSink appends newline-delimited JSON to a file, for offline analysis.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens (creating if necessary) the file at path for appending.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (s *FileSink) Name() string { return "file" }
+
+func (s *FileSink) Record(ctx context.Context, e *tracedEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(line)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// HTTPWebhookSink POSTs each event to a configured URL, retrying with a
+// quadratically growing backoff (100ms, 400ms, 900ms, ...). It's modeled on the DMaaP "info job callback URL"
+// pattern, where a job type registers an endpoint that updates get pushed
+// to as they happen.
+type HTTPWebhookSink struct {
+	url           string
+	client        *http.Client
+	maxRetries    int
+	recordTimeout time.Duration
+}
+
+// NewHTTPWebhookSink returns a Sink that POSTs events to url.
+func NewHTTPWebhookSink(url string) *HTTPWebhookSink {
+	return &HTTPWebhookSink{
+		url:           url,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		maxRetries:    3,
+		recordTimeout: 5 * time.Second,
+	}
+}
+
+func (s *HTTPWebhookSink) Name() string { return "http-webhook" }
+
+// Record POSTs e to the webhook URL, retrying with backoff on failure. The
+// attempt loop is bounded by recordTimeout regardless of ctx's own deadline,
+// so a slow or unreachable subscriber can't hold up the caller beyond a
+// short, fixed budget.
+func (s *HTTPWebhookSink) Record(ctx context.Context, e *tracedEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, s.recordTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt*attempt) * 100 * time.Millisecond):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return lastErr
+}
+
+func (s *HTTPWebhookSink) Close() error { return nil }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/go-events/jobevents"
+)
+
+func TestPostgresSinkRecord(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+
+	var lastInsertID int64
+	mock.ExpectExec("INSERT INTO job_status_updates").
+		WithArgs("invID", "message", "state", "0.0.0.0", "0.0.0.0", int64(0), "app-id", "user").
+		WillReturnResult(sqlmock.NewResult(lastInsertID, 1))
+
+	sink := NewPostgresSink(app)
+	e := &tracedEvent{JobEvent: &jobevents.JobEvent{JobId: "invID", Message: "message", JobState: "state", Host: "", AppId: "app-id", User: "user"}}
+	if err := sink.Record(context.Background(), e); err != nil {
+		t.Errorf("error was not expected recording to the postgres sink: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations inserting job_status_updates: %s", err)
+	}
+}
+
+func TestFileSinkRecord(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.ndjson")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("error creating file sink: %s", err)
+	}
+
+	e := &tracedEvent{JobEvent: &jobevents.JobEvent{JobId: "invID", Message: "message"}, TraceID: "trace-id"}
+	if err := sink.Record(context.Background(), e); err != nil {
+		t.Errorf("error was not expected recording to the file sink: %s", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("error closing file sink: %s", err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading file sink output: %s", err)
+	}
+
+	var actual tracedEvent
+	actual.JobEvent = &jobevents.JobEvent{}
+	if err := json.Unmarshal(contents, &actual); err != nil {
+		t.Fatalf("error unmarshalling file sink line: %s", err)
+	}
+	if actual.JobId != "invID" {
+		t.Errorf("job id was %s instead of invID", actual.JobId)
+	}
+	if actual.TraceID != "trace-id" {
+		t.Errorf("trace id was %s instead of trace-id", actual.TraceID)
+	}
+}
+
+func TestHTTPWebhookSinkRecord(t *testing.T) {
+	received := tracedEvent{JobEvent: &jobevents.JobEvent{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("error decoding webhook body: %s", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPWebhookSink(server.URL)
+	e := &tracedEvent{JobEvent: &jobevents.JobEvent{JobId: "invID", Message: "message"}, TraceID: "trace-id"}
+	if err := sink.Record(context.Background(), e); err != nil {
+		t.Errorf("error was not expected recording to the webhook sink: %s", err)
+	}
+	if received.JobId != "invID" {
+		t.Errorf("webhook received job id %s instead of invID", received.JobId)
+	}
+	if received.TraceID != "trace-id" {
+		t.Errorf("webhook received trace id %s instead of trace-id", received.TraceID)
+	}
+}
+
+func TestHTTPWebhookSinkRetriesThenSucceeds(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPWebhookSink(server.URL)
+	e := &tracedEvent{JobEvent: &jobevents.JobEvent{JobId: "invID"}}
+	if err := sink.Record(context.Background(), e); err != nil {
+		t.Errorf("error was not expected after retries succeeded: %s", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+// failingSink always returns an error, for testing that one sink's failure
+// doesn't stop the others from running.
+type failingSink struct {
+	recorded int
+}
+
+func (s *failingSink) Name() string { return "failing" }
+func (s *failingSink) Record(ctx context.Context, e *tracedEvent) error {
+	s.recorded++
+	return errors.New("sink failure")
+}
+func (s *failingSink) Close() error { return nil }
+
+// recordingSink tracks every event it receives, for testing that it still
+// ran despite another sink failing.
+type recordingSink struct {
+	events []*tracedEvent
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+func (s *recordingSink) Record(ctx context.Context, e *tracedEvent) error {
+	s.events = append(s.events, e)
+	return nil
+}
+func (s *recordingSink) Close() error { return nil }
+
+func TestRecordToSinksPartialFailure(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	failing := &failingSink{}
+	recording := &recordingSink{}
+	app.sinks = []Sink{failing, recording}
+
+	e := &tracedEvent{JobEvent: &jobevents.JobEvent{JobId: "invID"}}
+	done, _ := app.recordToSinks(context.Background(), e, map[string]bool{})
+
+	if failing.recorded != 1 {
+		t.Errorf("failing sink was not called: %d", failing.recorded)
+	}
+	if len(recording.events) != 1 {
+		t.Errorf("recording sink did not receive the event: %d", len(recording.events))
+	}
+	if len(done) != 1 || done[0] != "recording" {
+		t.Errorf("expected only the recording sink reported as done, got %v", done)
+	}
+}
+
+func TestRecordToSinksSkipsAlreadyDoneSinks(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	recording := &recordingSink{}
+	app.sinks = []Sink{recording}
+
+	e := &tracedEvent{JobEvent: &jobevents.JobEvent{JobId: "invID"}}
+	done, errs := app.recordToSinks(context.Background(), e, map[string]bool{"recording": true})
+
+	if len(errs) != 0 {
+		t.Errorf("expected no errors skipping an already-done sink, got %v", errs)
+	}
+	if len(recording.events) != 0 {
+		t.Errorf("expected the already-done sink not to be recorded again, got %d calls", len(recording.events))
+	}
+	if len(done) != 1 || done[0] != "recording" {
+		t.Errorf("expected the skipped sink still reported as done, got %v", done)
+	}
+}
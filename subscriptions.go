@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/go-events/jobevents"
+	"github.com/cyverse-de/logcabin"
+	"github.com/cyverse-de/messaging"
+)
+
+// maxSubscriptionConcurrency bounds how many callback POSTs run at once for
+// a single event.
+const maxSubscriptionConcurrency = 8
+
+var subscriptionHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// SubscriptionSpec describes the events a subscriber wants delivered and
+// where to deliver them.
+type SubscriptionSpec struct {
+	States      []messaging.JobState `json:"states,omitempty"`
+	AppID       string               `json:"app_id,omitempty"`
+	User        string               `json:"user,omitempty"`
+	ExecutorID  string               `json:"executor_id,omitempty"`
+	CallbackURL string               `json:"callback_url"`
+}
+
+// Subscription is the public, JSON-safe view of a persisted subscription;
+// it omits the HMAC secret.
+type Subscription struct {
+	ID   string           `json:"id"`
+	Spec SubscriptionSpec `json:"spec"`
+}
+
+// subscription is a persisted SubscriptionSpec plus the secret used to sign
+// its callbacks.
+type subscription struct {
+	id     string
+	spec   SubscriptionSpec
+	secret string
+}
+
+// matches reports whether e satisfies every filter set on the subscription.
+// An empty filter matches anything.
+func (s *subscription) matches(e *jobevents.JobEvent) bool {
+	if len(s.spec.States) > 0 {
+		found := false
+		for _, state := range s.spec.States {
+			if string(state) == e.JobState {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if s.spec.AppID != "" && s.spec.AppID != e.AppId {
+		return false
+	}
+	if s.spec.User != "" && s.spec.User != e.User {
+		return false
+	}
+	if s.spec.ExecutorID != "" && s.spec.ExecutorID != e.ExecutorId {
+		return false
+	}
+	return true
+}
+
+// newSubscriptionSecret generates the HMAC secret used to sign a
+// subscription's callbacks.
+func newSubscriptionSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// signBody returns the hex-encoded HMAC-SHA256 of body under secret.
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Subscribe persists spec and registers it to receive matching events.
+func (a *App) Subscribe(spec SubscriptionSpec) (string, error) {
+	if spec.CallbackURL == "" {
+		return "", fmt.Errorf("callback_url is required")
+	}
+
+	secret, err := newSubscriptionSecret()
+	if err != nil {
+		return "", err
+	}
+
+	statesJSON, err := json.Marshal(spec.States)
+	if err != nil {
+		return "", err
+	}
+
+	id := newRequestID()
+	_, err = a.db.Exec(`INSERT INTO job_event_subscriptions
+		(id, states, app_id, "user", executor_id, callback_url, secret)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		id, statesJSON, spec.AppID, spec.User, spec.ExecutorID, spec.CallbackURL, secret)
+	if err != nil {
+		return "", err
+	}
+
+	a.subsMu.Lock()
+	a.subs[id] = &subscription{id: id, spec: spec, secret: secret}
+	a.subsMu.Unlock()
+
+	return id, nil
+}
+
+// Unsubscribe removes a subscription by id.
+func (a *App) Unsubscribe(id string) error {
+	if _, err := a.db.Exec(`DELETE FROM job_event_subscriptions WHERE id = $1`, id); err != nil {
+		return err
+	}
+
+	a.subsMu.Lock()
+	delete(a.subs, id)
+	a.subsMu.Unlock()
+
+	return nil
+}
+
+// loadSubscriptions populates a.subs from every row in
+// job_event_subscriptions, so that subscriptions registered before a
+// restart keep receiving callbacks instead of silently going stale until
+// re-registered. Init calls this before consumers start.
+func (a *App) loadSubscriptions() error {
+	rows, err := a.db.Query(`SELECT id, states, app_id, "user", executor_id, callback_url, secret
+		FROM job_event_subscriptions`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	subs := make(map[string]*subscription)
+	for rows.Next() {
+		var id, appID, user, executorID, callbackURL, secret string
+		var statesJSON []byte
+		if err := rows.Scan(&id, &statesJSON, &appID, &user, &executorID, &callbackURL, &secret); err != nil {
+			return err
+		}
+
+		var states []messaging.JobState
+		if err := json.Unmarshal(statesJSON, &states); err != nil {
+			return err
+		}
+
+		subs[id] = &subscription{
+			id: id,
+			spec: SubscriptionSpec{
+				States:      states,
+				AppID:       appID,
+				User:        user,
+				ExecutorID:  executorID,
+				CallbackURL: callbackURL,
+			},
+			secret: secret,
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	a.subsMu.Lock()
+	a.subs = subs
+	a.subsMu.Unlock()
+
+	return nil
+}
+
+// ListSubscriptions returns every currently registered subscription.
+func (a *App) ListSubscriptions() []Subscription {
+	a.subsMu.RLock()
+	defer a.subsMu.RUnlock()
+
+	out := make([]Subscription, 0, len(a.subs))
+	for _, s := range a.subs {
+		out = append(out, Subscription{ID: s.id, Spec: s.spec})
+	}
+	return out
+}
+
+// dispatchSubscriptions POSTs e to every subscription whose filters match
+// it, bounding how many callbacks run concurrently. It returns as soon as
+// the matching subscriptions are found; the callbacks themselves run in a
+// background goroutine so a slow or unreachable subscriber can't stall the
+// AMQP delivery handler that called it. One subscriber's failure doesn't
+// affect delivery to the others. e carries the trace ID of the delivery
+// that produced it, which is signed and posted along with the rest of the
+// body so subscribers can correlate callbacks with it.
+func (a *App) dispatchSubscriptions(ctx context.Context, e *tracedEvent) {
+	a.subsMu.RLock()
+	matched := make([]*subscription, 0)
+	for _, s := range a.subs {
+		if s.matches(e.JobEvent) {
+			matched = append(matched, s)
+		}
+	}
+	a.subsMu.RUnlock()
+
+	if len(matched) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		logcabin.Error.Printf("trace=%s: %s", requestID(ctx), err)
+		return
+	}
+
+	go func() {
+		sem := make(chan struct{}, maxSubscriptionConcurrency)
+		var wg sync.WaitGroup
+		for _, s := range matched {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(s *subscription) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := postToSubscriber(ctx, s, body); err != nil {
+					logcabin.Error.Printf("trace=%s subscription=%s: %s", requestID(ctx), s.id, err)
+				}
+			}(s)
+		}
+		wg.Wait()
+	}()
+}
+
+// postToSubscriber sends e's JSON body to a subscription's callback URL,
+// signed with the subscription's secret.
+func postToSubscriber(ctx context.Context, s *subscription, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.spec.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", signBody(s.secret, body))
+
+	resp, err := subscriptionHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// subscriptionsHandler lists (GET) or creates (POST) subscriptions.
+func (a *App) subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.ListSubscriptions())
+	case http.MethodPost:
+		var spec SubscriptionSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		id, err := a.Subscribe(spec)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// subscriptionHandler removes a single subscription by id.
+func (a *App) subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/subscriptions/")
+	if id == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("missing subscription id"))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.Unsubscribe(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
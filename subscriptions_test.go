@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/go-events/jobevents"
+	"github.com/cyverse-de/messaging"
+)
+
+func TestSubscribePersists(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+
+	mock.ExpectExec("INSERT INTO job_event_subscriptions").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "app", "user", "executor", "http://example.org/callback", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	spec := SubscriptionSpec{
+		States:      []messaging.JobState{messaging.JobState("Completed")},
+		AppID:       "app",
+		User:        "user",
+		ExecutorID:  "executor",
+		CallbackURL: "http://example.org/callback",
+	}
+	id, err := app.Subscribe(spec)
+	if err != nil {
+		t.Fatalf("error subscribing: %s", err)
+	}
+	if id == "" {
+		t.Error("expected a non-empty subscription id")
+	}
+
+	subs := app.ListSubscriptions()
+	if len(subs) != 1 {
+		t.Fatalf("expected 1 subscription listed, got %d", len(subs))
+	}
+	if subs[0].ID != id {
+		t.Errorf("listed subscription id %s did not match %s", subs[0].ID, id)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSubscribeRequiresCallbackURL(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+
+	if _, err := app.Subscribe(SubscriptionSpec{}); err == nil {
+		t.Error("expected an error subscribing without a callback url")
+	}
+}
+
+func TestLoadSubscriptionsRepopulatesSubs(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+
+	statesJSON, err := json.Marshal([]messaging.JobState{messaging.JobState("Completed")})
+	if err != nil {
+		t.Fatalf("error marshalling states: %s", err)
+	}
+	rows := sqlmock.NewRows([]string{"id", "states", "app_id", "user", "executor_id", "callback_url", "secret"}).
+		AddRow("sub-id", statesJSON, "app", "user", "executor", "http://example.org/callback", "secret")
+	mock.ExpectQuery("SELECT (.+) FROM job_event_subscriptions").WillReturnRows(rows)
+
+	if err := app.loadSubscriptions(); err != nil {
+		t.Fatalf("error loading subscriptions: %s", err)
+	}
+
+	subs := app.ListSubscriptions()
+	if len(subs) != 1 {
+		t.Fatalf("expected 1 subscription loaded, got %d", len(subs))
+	}
+	if subs[0].ID != "sub-id" || subs[0].Spec.CallbackURL != "http://example.org/callback" {
+		t.Errorf("unexpected subscription contents: %+v", subs[0])
+	}
+
+	app.subsMu.RLock()
+	secret := app.subs["sub-id"].secret
+	app.subsMu.RUnlock()
+	if secret != "secret" {
+		t.Errorf("loaded subscription secret was %q instead of %q", secret, "secret")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUnsubscribeRemoves(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+
+	mock.ExpectExec("INSERT INTO job_event_subscriptions").WillReturnResult(sqlmock.NewResult(0, 1))
+	id, err := app.Subscribe(SubscriptionSpec{CallbackURL: "http://example.org/callback"})
+	if err != nil {
+		t.Fatalf("error subscribing: %s", err)
+	}
+
+	mock.ExpectExec("DELETE FROM job_event_subscriptions").WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := app.Unsubscribe(id); err != nil {
+		t.Fatalf("error unsubscribing: %s", err)
+	}
+
+	if subs := app.ListSubscriptions(); len(subs) != 0 {
+		t.Errorf("expected no subscriptions after unsubscribing, got %d", len(subs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSendJobEventDispatchesOnlyToMatchingSubscriptions(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	app.amqpClient = &MockMessenger{publishedMessages: make([]MockMessage, 0)}
+
+	matchedCh := make(chan *jobevents.JobEvent, 1)
+	matched := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e jobevents.JobEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		matchedCh <- &e
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer matched.Close()
+
+	unmatchedCalled := false
+	unmatched := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unmatchedCalled = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer unmatched.Close()
+
+	app.subs["matched"] = &subscription{
+		id:     "matched",
+		spec:   SubscriptionSpec{States: []messaging.JobState{messaging.JobState("Completed")}, CallbackURL: matched.URL},
+		secret: "secret",
+	}
+	app.subs["unmatched"] = &subscription{
+		id:     "unmatched",
+		spec:   SubscriptionSpec{States: []messaging.JobState{messaging.JobState("Failed")}, CallbackURL: unmatched.URL},
+		secret: "secret",
+	}
+
+	e := &jobevents.JobEvent{JobId: "invID", JobState: "Completed"}
+	if err := app.sendJobEvent(context.Background(), e); err != nil {
+		t.Fatalf("error sending job event: %s", err)
+	}
+
+	select {
+	case received := <-matchedCh:
+		if received.JobId != "invID" {
+			t.Errorf("matched subscriber received job id %s instead of invID", received.JobId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected the matching subscription to receive the event")
+	}
+
+	if unmatchedCalled {
+		t.Error("expected the non-matching subscription not to receive the event")
+	}
+}
+
+func TestSubscriptionsHandlers(t *testing.T) {
+	inittests(t)
+	app := New(cfg)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was encountered when creating the mock database", err)
+	}
+	defer db.Close()
+	app.db = db
+
+	mock.ExpectExec("INSERT INTO job_event_subscriptions").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body, err := json.Marshal(SubscriptionSpec{CallbackURL: "http://example.org/callback"})
+	if err != nil {
+		t.Fatalf("error marshalling subscription spec: %s", err)
+	}
+	postReq := httptest.NewRequest("POST", "/subscriptions", bytes.NewReader(body))
+	postW := httptest.NewRecorder()
+	app.subscriptionsHandler(postW, postReq)
+	if postW.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created subscribing, got %d", postW.Code)
+	}
+
+	var created map[string]string
+	if err := json.Unmarshal(postW.Body.Bytes(), &created); err != nil {
+		t.Fatalf("error unmarshalling subscribe response: %s", err)
+	}
+	id := created["id"]
+	if id == "" {
+		t.Fatal("expected a subscription id in the response")
+	}
+
+	listReq := httptest.NewRequest("GET", "/subscriptions", nil)
+	listW := httptest.NewRecorder()
+	app.subscriptionsHandler(listW, listReq)
+	var listed []Subscription
+	if err := json.Unmarshal(listW.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("error unmarshalling subscription list: %s", err)
+	}
+	if len(listed) != 1 {
+		t.Fatalf("expected 1 subscription listed, got %d", len(listed))
+	}
+
+	mock.ExpectExec("DELETE FROM job_event_subscriptions").WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+	delReq := httptest.NewRequest("DELETE", "/subscriptions/"+id, nil)
+	delW := httptest.NewRecorder()
+	app.subscriptionHandler(delW, delReq)
+	if delW.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 No Content unsubscribing, got %d", delW.Code)
+	}
+
+	if subs := app.ListSubscriptions(); len(subs) != 0 {
+		t.Errorf("expected no subscriptions remaining, got %d", len(subs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}